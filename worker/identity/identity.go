@@ -0,0 +1,165 @@
+// Package identity gives each worker a stable, self-issued node identity:
+// an ECDSA keypair, a node ID derived from the public key (the same way
+// Ethereum bootnodes derive theirs), and a self-signed TLS certificate the
+// worker presents on every RPC hop. There is no CA in this system - the LB
+// pins each worker's certificate fingerprint at registration time and hands
+// it back out to peers, who verify against that fingerprint instead.
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Identity is a worker's long-lived keypair plus the derived node ID and
+// self-signed certificate built from it.
+type Identity struct {
+	Key         *ecdsa.PrivateKey
+	ID          string
+	Cert        tls.Certificate
+	fingerprint [32]byte
+}
+
+// Load loads an ECDSA key from keyPath if set, otherwise generates a new
+// one. If genPath is set the (possibly freshly generated) key is written
+// there so future runs with -nodekey can reuse the same identity.
+func Load(keyPath, genPath string) (*Identity, error) {
+	var key *ecdsa.PrivateKey
+	var err error
+	switch {
+	case keyPath != "":
+		key, err = loadKey(keyPath)
+	default:
+		key, err = generateKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if genPath != "" {
+		if err := saveKey(genPath, key); err != nil {
+			return nil, err
+		}
+	}
+	return newIdentity(key)
+}
+
+func generateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("identity: no PEM block found in " + path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func saveKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// NodeID derives a stable identity string from an ECDSA public key: the
+// SHA-256 of its uncompressed point, hex encoded.
+func NodeID(pub *ecdsa.PublicKey) string {
+	raw := elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func newIdentity(key *ecdsa.PrivateKey) (*Identity, error) {
+	id := NodeID(&key.PublicKey)
+	certDER, err := selfSignedCert(key, id)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Key: key,
+		ID:  id,
+		Cert: tls.Certificate{
+			Certificate: [][]byte{certDER},
+			PrivateKey:  key,
+		},
+		fingerprint: sha256.Sum256(certDER),
+	}, nil
+}
+
+// Fingerprint is the SHA-256 of the DER-encoded certificate - the value the
+// LB pins per worker and hands back out (e.g. in GetNodes) for peers to
+// verify against.
+func (i *Identity) Fingerprint() string {
+	return hex.EncodeToString(i.fingerprint[:])
+}
+
+// FingerprintCert computes the same fingerprint for an arbitrary
+// DER-encoded certificate, so callers verifying an incoming peer's
+// certificate against a set of LB-vouched fingerprints don't need to build a
+// whole Identity just to hash one.
+func FingerprintCert(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func selfSignedCert(key *ecdsa.PrivateKey, nodeID string) ([]byte, error) {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: nodeID},
+		DNSNames:              []string{nodeID},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+}
+
+// TLSConfig returns a mutual-TLS config presenting this identity's
+// certificate. Since there's no CA, normal chain validation is skipped in
+// favor of checking the peer's certificate fingerprint against
+// wantFingerprint; an empty wantFingerprint accepts any peer certificate
+// without checking it (the worker's first handshake with the LB in
+// registerWithLB uses this, and does not check the LB's certificate
+// afterward).
+func (i *Identity) TLSConfig(wantFingerprint string) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{i.Cert},
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if wantFingerprint == "" {
+				return nil
+			}
+			if len(rawCerts) == 0 {
+				return errors.New("identity: peer presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			got := hex.EncodeToString(sum[:])
+			if got != wantFingerprint {
+				return fmt.Errorf("identity: peer certificate fingerprint mismatch: got %s want %s", got, wantFingerprint)
+			}
+			return nil
+		},
+	}
+}
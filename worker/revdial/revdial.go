@@ -0,0 +1,414 @@
+// Package revdial lets two peers that already share one TCP (or other
+// io.ReadWriteCloser) connection open additional logical connections over
+// it, in either direction. It exists so a worker that cannot accept inbound
+// connections (behind a NAT/firewall) can still be dialed: the worker keeps
+// its control connection to the load balancer open and the LB (or a peer
+// worker relayed through the LB) "dials back" through that same socket.
+//
+// The wire format is a simple length-prefixed frame: a 1 byte type, a 4 byte
+// connection ID, and a 4 byte payload length, all big endian, followed by
+// the payload itself.
+package revdial
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type frameType byte
+
+const (
+	frameDial frameType = iota
+	frameData
+	frameClose
+	framePing
+	framePong
+)
+
+const frameHeaderLen = 1 + 4 + 4
+
+var ErrClosed = errors.New("revdial: connection closed")
+
+// Dialer is the side that holds a control connection and wants to open new
+// logical connections through it (the load balancer, or a peer worker
+// relayed through the load balancer). Dial does not wait for the remote end
+// to accept the new connection.
+type Dialer struct {
+	conn      io.ReadWriteCloser
+	wmu       sync.Mutex
+	conns     dialerConns
+	nextID    uint32
+	idMu      sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+	lastPong  chan struct{}
+}
+
+// NewDialer wraps c, which must already be established, and starts reading
+// frames off of it in the background.
+func NewDialer(c io.ReadWriteCloser) *Dialer {
+	d := &Dialer{
+		conn:     c,
+		closed:   make(chan struct{}),
+		lastPong: make(chan struct{}, 1),
+	}
+	d.conns.byID = make(map[uint32]*conn)
+	go d.readLoop()
+	return d
+}
+
+// Dial opens a new logical net.Conn over the control connection. The
+// returned conn is usable immediately; bytes written to it queue up on the
+// wire until the accepting side starts reading.
+func (d *Dialer) Dial() (net.Conn, error) {
+	d.idMu.Lock()
+	d.nextID++
+	id := d.nextID
+	d.idMu.Unlock()
+
+	if err := writeFrame(d.conn, &d.wmu, frameDial, id, nil); err != nil {
+		return nil, err
+	}
+
+	c := newConn(d, id)
+	d.registerConn(c)
+	return c, nil
+}
+
+// Ping checks that the tunnel is still alive, returning an error if no pong
+// is heard within timeout. Callers use this to detect a dead control
+// connection and trigger a reconnect.
+func (d *Dialer) Ping(timeout time.Duration) error {
+	if err := writeFrame(d.conn, &d.wmu, framePing, 0, nil); err != nil {
+		return err
+	}
+	select {
+	case <-d.lastPong:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("revdial: ping timeout")
+	case <-d.closed:
+		return ErrClosed
+	}
+}
+
+func (d *Dialer) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		d.conn.Close()
+	})
+	return nil
+}
+
+// Listener is the side behind the NAT/firewall: it cannot accept inbound
+// dials of its own, so it holds the other end of the control connection and
+// turns incoming frameDial frames into connections handed out via Accept.
+type Listener struct {
+	conn      io.ReadWriteCloser
+	wmu       sync.Mutex
+	accept    chan *conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	lastPong  chan struct{}
+}
+
+// NewListener wraps c, which must already be established, and starts reading
+// frames off of it in the background.
+func NewListener(c io.ReadWriteCloser) *Listener {
+	l := &Listener{
+		conn:     c,
+		accept:   make(chan *conn, 4),
+		closed:   make(chan struct{}),
+		lastPong: make(chan struct{}, 1),
+	}
+	go l.readLoop()
+	return l
+}
+
+// Ping checks that the control connection is still alive, returning an error
+// if no pong is heard within timeout.
+func (l *Listener) Ping(timeout time.Duration) error {
+	if err := writeFrame(l.conn, &l.wmu, framePing, 0, nil); err != nil {
+		return err
+	}
+	select {
+	case <-l.lastPong:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("revdial: ping timeout")
+	case <-l.closed:
+		return ErrClosed
+	}
+}
+
+// Accept blocks until the peer on the other end of the control connection
+// dials through, returning a net.Conn ready for rpc.ServeConn.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *Listener) readLoop() {
+	defer l.Close()
+	conns := make(map[uint32]*conn)
+	br := bufio.NewReader(l.conn)
+	for {
+		typ, id, data, err := readFrame(br)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameDial:
+			c := newConn(nil, id)
+			c.listener = l
+			conns[id] = c
+			select {
+			case l.accept <- c:
+			case <-l.closed:
+				return
+			}
+		case frameData:
+			if c := conns[id]; c != nil {
+				c.deliver(data)
+			}
+		case frameClose:
+			if c := conns[id]; c != nil {
+				delete(conns, id)
+				c.remoteClosed()
+			}
+		case framePing:
+			writeFrame(l.conn, &l.wmu, framePong, 0, nil)
+		case framePong:
+			select {
+			case l.lastPong <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (d *Dialer) readLoop() {
+	defer d.Close()
+	br := bufio.NewReader(d.conn)
+	for {
+		typ, id, data, err := readFrame(br)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameData:
+			if c := d.lookupConn(id); c != nil {
+				c.deliver(data)
+			}
+		case frameClose:
+			if c := d.lookupConn(id); c != nil {
+				d.forgetConn(id)
+				c.remoteClosed()
+			}
+		case framePong:
+			select {
+			case d.lastPong <- struct{}{}:
+			default:
+			}
+		case framePing:
+			writeFrame(d.conn, &d.wmu, framePong, 0, nil)
+		}
+	}
+}
+
+// dialerConns tracks the Dialer side's live logical connections, keyed by
+// connection ID, guarded by its own mutex.
+type dialerConns struct {
+	mu   sync.Mutex
+	byID map[uint32]*conn
+}
+
+func (d *Dialer) registerConn(c *conn) {
+	d.conns.mu.Lock()
+	d.conns.byID[c.id] = c
+	d.conns.mu.Unlock()
+}
+
+func (d *Dialer) lookupConn(id uint32) *conn {
+	d.conns.mu.Lock()
+	c := d.conns.byID[id]
+	d.conns.mu.Unlock()
+	return c
+}
+
+func (d *Dialer) forgetConn(id uint32) {
+	d.conns.mu.Lock()
+	delete(d.conns.byID, id)
+	d.conns.mu.Unlock()
+}
+
+func writeFrame(w io.Writer, mu *sync.Mutex, typ frameType, connID uint32, data []byte) error {
+	mu.Lock()
+	defer mu.Unlock()
+	hdr := make([]byte, frameHeaderLen)
+	hdr[0] = byte(typ)
+	binary.BigEndian.PutUint32(hdr[1:5], connID)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(data)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFrame(r *bufio.Reader) (typ frameType, connID uint32, data []byte, err error) {
+	hdr := make([]byte, frameHeaderLen)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	typ = frameType(hdr[0])
+	connID = binary.BigEndian.Uint32(hdr[1:5])
+	length := binary.BigEndian.Uint32(hdr[5:9])
+	if length > 0 {
+		data = make([]byte, length)
+		_, err = io.ReadFull(r, data)
+	}
+	return
+}
+
+// conn is a single logical stream muxed over a Dialer/Listener's shared
+// control connection. It implements net.Conn.
+//
+// deliver queues incoming data onto readQueue instead of writing it straight
+// into something Read blocks on: readLoop is the only goroutine demuxing
+// every conn sharing the tunnel, so if deliver blocked waiting for a slow
+// consumer of this one conn, every other conn - including framePing/framePong
+// processing - would wedge behind it.
+type conn struct {
+	dialer   *Dialer
+	listener *Listener
+	id       uint32
+
+	readMu    sync.Mutex
+	readCond  *sync.Cond
+	readQueue [][]byte
+	readErr   error
+	closed    bool
+
+	closeOnce sync.Once
+}
+
+func newConn(d *Dialer, id uint32) *conn {
+	c := &conn{dialer: d, id: id}
+	c.readCond = sync.NewCond(&c.readMu)
+	return c
+}
+
+func (c *conn) deliver(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	buf := append([]byte(nil), p...)
+	c.readMu.Lock()
+	if c.closed {
+		c.readMu.Unlock()
+		return
+	}
+	c.readQueue = append(c.readQueue, buf)
+	c.readMu.Unlock()
+	c.readCond.Signal()
+}
+
+func (c *conn) remoteClosed() {
+	c.readMu.Lock()
+	if c.readErr == nil {
+		c.readErr = io.EOF
+	}
+	c.readMu.Unlock()
+	c.readCond.Signal()
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	for len(c.readQueue) == 0 && c.readErr == nil && !c.closed {
+		c.readCond.Wait()
+	}
+	if len(c.readQueue) == 0 {
+		err := c.readErr
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		c.readMu.Unlock()
+		return 0, err
+	}
+	chunk := c.readQueue[0]
+	n := copy(p, chunk)
+	if n < len(chunk) {
+		c.readQueue[0] = chunk[n:]
+	} else {
+		c.readQueue = c.readQueue[1:]
+	}
+	c.readMu.Unlock()
+	return n, nil
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	var underlying io.ReadWriteCloser
+	var mu *sync.Mutex
+	if c.dialer != nil {
+		underlying, mu = c.dialer.conn, &c.dialer.wmu
+	} else {
+		underlying, mu = c.listener.conn, &c.listener.wmu
+	}
+	if err := writeFrame(underlying, mu, frameData, c.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		var underlying io.ReadWriteCloser
+		var mu *sync.Mutex
+		if c.dialer != nil {
+			underlying, mu = c.dialer.conn, &c.dialer.wmu
+			c.dialer.forgetConn(c.id)
+		} else {
+			underlying, mu = c.listener.conn, &c.listener.wmu
+		}
+		writeFrame(underlying, mu, frameClose, c.id, nil)
+		c.readMu.Lock()
+		c.closed = true
+		c.readMu.Unlock()
+		c.readCond.Signal()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr                { return addr(c.id) }
+func (c *conn) RemoteAddr() net.Addr               { return addr(c.id) }
+func (c *conn) SetDeadline(t time.Time) error      { return nil }
+func (c *conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *conn) SetWriteDeadline(t time.Time) error { return nil }
+
+type addr uint32
+
+func (a addr) Network() string { return "revdial" }
+func (a addr) String() string  { return fmt.Sprintf("revdial:%d", uint32(a)) }
@@ -0,0 +1,444 @@
+// Package transport multiplexes many concurrent streams over a single
+// connection between two workers, yamux-style, so a large CRDT transfer on
+// one stream doesn't head-of-line block a heartbeat on another.
+//
+// Each side of a Session can both OpenStream (to start a new logical
+// connection) and Accept (to receive one the other side opened); stream IDs
+// are split odd/even by which side is the "client" to avoid collisions, the
+// same trick yamux uses.
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config controls per-session and per-stream flow control.
+type Config struct {
+	// StreamWindowSize is how many unacknowledged bytes a single stream may
+	// have in flight before the writer blocks waiting for a window update.
+	StreamWindowSize uint32
+	// AcceptBacklog bounds how many not-yet-Accepted incoming streams a
+	// session will buffer before refusing new SYNs.
+	AcceptBacklog int
+	// KeepAliveInterval is how often a session pings the peer; a session
+	// that misses KeepAliveTimeout worth of pongs is declared dead.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+// DefaultConfig matches yamux's defaults closely enough for this project's
+// traffic: small control RPCs plus occasional large CRDT transfers.
+func DefaultConfig() *Config {
+	return &Config{
+		StreamWindowSize:  256 * 1024,
+		AcceptBacklog:     64,
+		KeepAliveInterval: 30 * time.Second,
+		KeepAliveTimeout:  10 * time.Second,
+	}
+}
+
+type frameType byte
+
+const (
+	typeSYN          frameType = iota // open a new stream
+	typeData                          // payload for an existing stream
+	typeWindowUpdate                  // grant the peer more send window
+	typeFIN                           // half-close a stream
+	typePing
+	typePong
+)
+
+const headerLen = 1 + 4 + 4 // type, streamID, length-or-window-delta
+
+// Session owns one underlying connection shared by many Streams.
+type Session struct {
+	conn     net.Conn
+	cfg      *Config
+	isClient bool
+
+	wmu sync.Mutex // serializes frame writes onto conn
+
+	mu        sync.Mutex
+	streams   map[uint32]*Stream
+	nextID    uint32
+	accept    chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+	lastPong  chan struct{}
+
+	closeErr error
+}
+
+// Client wraps conn as the dialing side of a new session.
+func Client(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, true)
+}
+
+// Server wraps conn as the accepting side of a new session.
+func Server(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, false)
+}
+
+func newSession(conn net.Conn, cfg *Config, isClient bool) *Session {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	s := &Session{
+		conn:     conn,
+		cfg:      cfg,
+		isClient: isClient,
+		streams:  make(map[uint32]*Stream),
+		accept:   make(chan *Stream, cfg.AcceptBacklog),
+		closed:   make(chan struct{}),
+		lastPong: make(chan struct{}, 1),
+	}
+	if isClient {
+		s.nextID = 1 // clients use odd stream IDs
+	} else {
+		s.nextID = 2 // servers use even stream IDs
+	}
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+// OpenStream starts a new logical stream to the peer. It writes the SYN
+// that tells the peer about the stream and returns without waiting for the
+// peer to Accept it.
+func (s *Session) OpenStream() (net.Conn, error) {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, s.errClosed()
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id, s.cfg.StreamWindowSize)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeSYN, id, nil); err != nil {
+		s.mu.Lock()
+		delete(s.streams, id)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream and returns it.
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, s.errClosed()
+	}
+}
+
+// Ping round-trips a keepalive frame, used to detect a dead session without
+// tearing down every stream on it.
+func (s *Session) Ping(timeout time.Duration) error {
+	if err := s.writeFrame(typePing, 0, nil); err != nil {
+		return err
+	}
+	select {
+	case <-s.lastPong:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("transport: keepalive timed out")
+	case <-s.closed:
+		return s.errClosed()
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+		s.mu.Lock()
+		for _, st := range s.streams {
+			st.remoteClosed(errors.New("transport: session closed"))
+		}
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+func (s *Session) errClosed() error {
+	if s.closeErr != nil {
+		return s.closeErr
+	}
+	return errors.New("transport: session closed")
+}
+
+func (s *Session) keepAlive() {
+	for {
+		select {
+		case <-time.After(s.cfg.KeepAliveInterval):
+		case <-s.closed:
+			return
+		}
+		if err := s.Ping(s.cfg.KeepAliveTimeout); err != nil {
+			s.closeErr = err
+			s.Close()
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+	br := bufio.NewReader(s.conn)
+	hdr := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return
+		}
+		typ := frameType(hdr[0])
+		streamID := binary.BigEndian.Uint32(hdr[1:5])
+		length := binary.BigEndian.Uint32(hdr[5:9])
+
+		switch typ {
+		case typeSYN:
+			st := newStream(s, streamID, s.cfg.StreamWindowSize)
+			s.mu.Lock()
+			s.streams[streamID] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			case <-s.closed:
+				return
+			default:
+				// Backlog full: refuse the stream by closing it straight back.
+				s.forgetStream(streamID)
+				s.writeFrame(typeFIN, streamID, nil)
+			}
+		case typeData:
+			data := make([]byte, length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return
+			}
+			if st := s.getStream(streamID); st != nil {
+				st.deliver(data)
+			}
+		case typeWindowUpdate:
+			if st := s.getStream(streamID); st != nil {
+				st.grantWindow(length)
+			}
+		case typeFIN:
+			if st := s.getStream(streamID); st != nil {
+				s.mu.Lock()
+				delete(s.streams, streamID)
+				s.mu.Unlock()
+				st.remoteClosed(io.EOF)
+			}
+		case typePing:
+			s.writeFrame(typePong, 0, nil)
+		case typePong:
+			select {
+			case s.lastPong <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	return st
+}
+
+func (s *Session) forgetStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeWindowUpdate(streamID uint32, delta uint32) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	hdr := make([]byte, headerLen)
+	hdr[0] = byte(typeWindowUpdate)
+	binary.BigEndian.PutUint32(hdr[1:5], streamID)
+	binary.BigEndian.PutUint32(hdr[5:9], delta)
+	_, err := s.conn.Write(hdr)
+	return err
+}
+
+func (s *Session) writeFrame(typ frameType, streamID uint32, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	hdr := make([]byte, headerLen)
+	hdr[0] = byte(typ)
+	binary.BigEndian.PutUint32(hdr[1:5], streamID)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(data)))
+	if _, err := s.conn.Write(hdr); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := s.conn.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream is a single flow-controlled, bidirectional logical connection
+// multiplexed over a Session. It implements net.Conn so rpc.NewClient /
+// rpc.ServeConn can use it directly.
+//
+// deliver queues incoming data onto readQueue rather than writing it
+// straight into something Read blocks on: recvLoop is the only goroutine
+// demuxing every stream on the session, so if deliver blocked waiting for a
+// slow consumer of this one stream, every other stream - including the
+// session's own ping/pong keepalive - would wedge behind it.
+type Stream struct {
+	session *Session
+	id      uint32
+
+	readMu    sync.Mutex
+	readCond  *sync.Cond
+	readQueue [][]byte
+	readErr   error
+	closed    bool
+
+	sendWindow   uint32
+	sendWindowMu sync.Mutex
+	windowGrant  chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newStream(s *Session, id uint32, window uint32) *Stream {
+	st := &Stream{
+		session:     s,
+		id:          id,
+		sendWindow:  window,
+		windowGrant: make(chan struct{}, 1),
+	}
+	st.readCond = sync.NewCond(&st.readMu)
+	return st
+}
+
+func (st *Stream) deliver(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	buf := append([]byte(nil), p...)
+	st.readMu.Lock()
+	if st.closed {
+		st.readMu.Unlock()
+		return
+	}
+	st.readQueue = append(st.readQueue, buf)
+	st.readMu.Unlock()
+	st.readCond.Signal()
+}
+
+func (st *Stream) remoteClosed(err error) {
+	st.readMu.Lock()
+	if st.readErr == nil {
+		st.readErr = err
+	}
+	st.readMu.Unlock()
+	st.readCond.Signal()
+}
+
+func (st *Stream) grantWindow(delta uint32) {
+	st.sendWindowMu.Lock()
+	st.sendWindow += delta
+	st.sendWindowMu.Unlock()
+	select {
+	case st.windowGrant <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.readMu.Lock()
+	for len(st.readQueue) == 0 && st.readErr == nil && !st.closed {
+		st.readCond.Wait()
+	}
+	if len(st.readQueue) == 0 {
+		err := st.readErr
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		st.readMu.Unlock()
+		return 0, err
+	}
+	chunk := st.readQueue[0]
+	n := copy(p, chunk)
+	if n < len(chunk) {
+		st.readQueue[0] = chunk[n:]
+	} else {
+		st.readQueue = st.readQueue[1:]
+	}
+	st.readMu.Unlock()
+	if n > 0 {
+		// Every byte delivered to the reader frees that much window on the
+		// sender's side. typeWindowUpdate repurposes the length field of the
+		// frame header to carry the window delta instead of a payload size.
+		st.session.writeWindowUpdate(st.id, uint32(n))
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.sendWindowMu.Lock()
+		avail := st.sendWindow
+		st.sendWindowMu.Unlock()
+		if avail == 0 {
+			select {
+			case <-st.windowGrant:
+				continue
+			case <-st.session.closed:
+				return written, st.session.errClosed()
+			}
+		}
+		chunk := p[written:]
+		if uint32(len(chunk)) > avail {
+			chunk = chunk[:avail]
+		}
+		if err := st.session.writeFrame(typeData, st.id, chunk); err != nil {
+			return written, err
+		}
+		st.sendWindowMu.Lock()
+		st.sendWindow -= uint32(len(chunk))
+		st.sendWindowMu.Unlock()
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (st *Stream) Close() error {
+	st.closeOnce.Do(func() {
+		st.session.writeFrame(typeFIN, st.id, nil)
+		st.session.forgetStream(st.id)
+		st.readMu.Lock()
+		st.closed = true
+		st.readMu.Unlock()
+		st.readCond.Signal()
+	})
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr                { return st.session.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr               { return st.session.conn.RemoteAddr() }
+func (st *Stream) SetDeadline(t time.Time) error      { return nil }
+func (st *Stream) SetReadDeadline(t time.Time) error  { return nil }
+func (st *Stream) SetWriteDeadline(t time.Time) error { return nil }
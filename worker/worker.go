@@ -4,7 +4,12 @@ Port is dynamic
 
 Usage:
 
-$ go run worker.go [loadbalancer ip:port]
+$ go run worker.go [loadbalancer ip:port] [revdial]
+
+Pass "revdial" as a second argument if this worker is behind a NAT/firewall
+and cannot accept inbound connections; it will keep a control connection to
+the load balancer open instead, and peers reach it through that tunnel (see
+the revdial package).
 
 */
 package main
@@ -12,32 +17,77 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/gob"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/nathanmcsu/cs416_proj2/worker/identity"
+	"github.com/nathanmcsu/cs416_proj2/worker/revdial"
+	"github.com/nathanmcsu/cs416_proj2/worker/transport"
+	"github.com/nathanmcsu/cs416_proj2/worker/xlog"
 )
 
+// workerMuxHandshake is written by connectToWorkers/BidirectionalSetup before
+// handing a freshly dialed connection off to the transport package, so the
+// accepting side's listenRPC loop can tell a multiplexed peer session apart
+// from a plain single-shot RPC connection (e.g. from the LB).
+const workerMuxHandshake = "WORKERMUX\n"
+
+// opStreamHandshake is written on a stream opened by startOpPusher before any
+// opStreamMsg frames, so serveMuxStream can tell a peer's dedicated
+// op-propagation stream apart from an ordinary one-shot RPC stream.
+const opStreamHandshake = "OPSTREAM\n"
+
 type WorkerNetSettings struct {
-	WorkerID                int `json:"workerID"`
-	HeartBeat               int `json:"heartbeat"`
-	MinNumWorkerConnections int `json:"min-num-worker-connections"`
+	WorkerID                int    `json:"workerID"`
+	HeartBeat               int    `json:"heartbeat"`
+	MinNumWorkerConnections int    `json:"min-num-worker-connections"`
+	LBFingerprint           string `json:"lb-fingerprint"`
 }
 
 type WorkerInfo struct {
 	RPCAddress  net.Addr
 	HTTPAddress net.Addr
+	Unreachable bool
+	Fingerprint string
+}
+
+// NodeInfo pairs a peer's dialable address with the certificate fingerprint
+// the LB pinned for it at registration time, so connectToWorkers can verify
+// the peer's identity during the TLS handshake even though there's no CA.
+type NodeInfo struct {
+	Addr        net.Addr
+	Fingerprint string
 }
 
+// revdialAddr is handed out by the LB (inside GetNodes's addrSet) in place of
+// a real dialable net.Addr whenever the peer it describes registered itself
+// as Unreachable. connectToWorkers recognizes this type and goes through
+// LBServer.DialThrough instead of dialing the address directly.
+type revdialAddr struct {
+	WorkerID int
+}
+
+func (a *revdialAddr) Network() string { return "revdial" }
+func (a *revdialAddr) String() string  { return fmt.Sprintf("revdial-worker-%d", a.WorkerID) }
+
 type Worker struct {
 	workerID         int
 	loadBalancerConn *rpc.Client
@@ -47,10 +97,36 @@ type Worker struct {
 	localHTTPAddr    net.Addr
 	externalIP       string
 	clients          map[string]*websocket.Conn
-	workers          map[string]*rpc.Client
-	logger           *log.Logger
+	workers          map[string]*transport.Session
+	logger           *xlog.Logger
 	crdt             map[string]*CRDT
-	localOps         []Element
+	unreachable          bool
+	revListener          *revdial.Listener
+	identity             *identity.Identity
+	acceptedFingerprints map[string]bool
+	peerPush             map[string]*peerPush
+	// peerAcks is peerAddr -> sessionID -> the last opID that peer has acked
+	// for that session. It's keyed per session, not just per peer, because
+	// opIDs are only unique within a session (newSession resets
+	// CRDT.NextOpNumber back to 1 each time) and a single peer's op stream
+	// interleaves ops from every session - an ack keyed on peerAddr alone
+	// would compare one session's opID against another session's progress.
+	peerAcks map[string]map[string]string
+	// mu guards workers, peerPush, peerAcks, acceptedFingerprints, and the
+	// crdt map itself (adding/removing sessions, not a *CRDT's own fields -
+	// see CRDT.mu for those). Once the event-driven op pipeline added one
+	// pusher/reader goroutine per peer, plus anti-entropy and compaction GC
+	// loops, these maps are read and written from many goroutines instead of
+	// just the single command loop they started out under.
+	mu sync.Mutex
+}
+
+// peerPush is one peer's dedicated op-propagation pipeline: broadcastOp is
+// the ring's producer, and runOpPusher drains it onto stream in coalesced
+// batches.
+type peerPush struct {
+	stream net.Conn
+	ring   *opRing
 }
 
 type WorkerResponse struct {
@@ -70,9 +146,25 @@ const (
 )
 
 type CRDT struct {
-	Elements map[string]*Element
-	CrdtFirstID string
+	Elements     map[string]*Element
+	CrdtFirstID  string
 	NextOpNumber int
+
+	// RootHash, OpCount, MinOpID and MaxOpID are a rolling anti-entropy
+	// summary kept up to date by updateCRDTSummary as ops are applied, so
+	// SyncSummary can answer without walking Elements on every call.
+	RootHash [32]byte
+	OpCount  int
+	MinOpID  string
+	MaxOpID  string
+
+	// mu guards every field above: Elements, CrdtFirstID, NextOpNumber, and
+	// the RootHash/OpCount/MinOpID/MaxOpID summary. A session's pusher
+	// goroutines, the anti-entropy reconciler, the compaction GC loop, and
+	// local edits from the command loop all touch the same *CRDT
+	// concurrently. addToCRDT and the other unexported helpers below assume
+	// the caller already holds it - see addToCRDT's doc comment.
+	mu sync.Mutex
 }
 
 type Element struct {
@@ -83,6 +175,10 @@ type Element struct {
 	PrevID   string
 	NextID   string
 	Text     string
+	// Type distinguishes an ordinary character insert from a delete op. A
+	// DELETE op doesn't take a place in the linked list itself - it reuses
+	// PrevID to carry the ID of the element it tombstones (see applyDelete).
+	Type OpType
 }
 
 type browserMsg struct {
@@ -93,6 +189,110 @@ type browserMsg struct {
 	Payload    string
 }
 
+// opStreamMsgType tags what an opStreamMsg carries over a peer's dedicated
+// op stream, which is bidirectional: the opening side pushes opMsgData
+// batches and the accepting side pushes opMsgAck back on the same stream.
+type opStreamMsgType int
+
+const (
+	opMsgData opStreamMsgType = iota
+	opMsgAck
+)
+
+type opStreamMsg struct {
+	Type opStreamMsgType
+	Ops  []Element // set for opMsgData
+	// Acks is set for opMsgAck: sessionID -> the last op.ID applied from this
+	// batch for that session. It's keyed per session, not just one AckID for
+	// the whole (possibly multi-session) batch, since opIDs are only unique
+	// within a session.
+	Acks map[string]string
+}
+
+const (
+	opRingCapacity        = 1024
+	opBatchByteThreshold  = 16 * 1024
+	opBatchCoalesceWindow = 20 * time.Millisecond
+)
+
+// opRing is a bounded ring buffer of Elements with a single producer
+// (broadcastOp, called right after a locally originated op is applied) and a
+// single consumer (that peer's runOpPusher goroutine). Pushes never block;
+// if the consumer falls more than opRingCapacity ops behind, the oldest
+// unread ones are overwritten and that peer just picks them up later via
+// anti-entropy instead of getting every intermediate op.
+type opRing struct {
+	buf    [opRingCapacity]Element
+	head   uint64
+	tail   uint64
+	signal chan struct{}
+}
+
+func newOpRing() *opRing {
+	return &opRing{signal: make(chan struct{}, 1)}
+}
+
+func (r *opRing) push(e Element) {
+	head := atomic.LoadUint64(&r.head)
+	r.buf[head%opRingCapacity] = e
+	atomic.StoreUint64(&r.head, head+1)
+	select {
+	case r.signal <- struct{}{}:
+	default:
+	}
+}
+
+// drain is a non-blocking, batched read. In the common case it hands back a
+// slice straight into the ring's own backing array instead of allocating -
+// the batch is only valid until the producer wraps around and overwrites
+// those slots again, so callers must be done with it (i.e. have encoded it)
+// before draining again. pooled is true only when a batch wrapped around the
+// end of the array and had to be copied into a buffer borrowed from
+// opBatchPool instead, which the caller must then return.
+func (r *opRing) drain() (batch []Element, pooled bool) {
+	tail := atomic.LoadUint64(&r.tail)
+	head := atomic.LoadUint64(&r.head)
+	if head == tail {
+		return nil, false
+	}
+	n := head - tail
+	if n > opRingCapacity {
+		tail = head - opRingCapacity // producer lapped us; oldest entries are gone
+		n = opRingCapacity
+	}
+	start := tail % opRingCapacity
+	end := start + n
+	atomic.StoreUint64(&r.tail, head)
+	if end <= opRingCapacity {
+		return r.buf[start:end], false
+	}
+	pooledBatch := opBatchPool.Get().([]Element)[:0]
+	pooledBatch = append(pooledBatch, r.buf[start:]...)
+	pooledBatch = append(pooledBatch, r.buf[:end-opRingCapacity]...)
+	return pooledBatch, true
+}
+
+var opBatchPool = sync.Pool{
+	New: func() interface{} { return make([]Element, 0, opRingCapacity) },
+}
+
+// elementPool lets ApplyIncomingOps hand addToCRDT a reusable *Element
+// instead of allocating one per incoming op; addToCRDT only ever reads it
+// into its own deep copy, so it's safe to return to the pool right after.
+var elementPool = sync.Pool{
+	New: func() interface{} { return new(Element) },
+}
+
+// approxOpBytes estimates a batch's wire size well enough to decide when to
+// stop coalescing and flush; it doesn't need to be exact.
+func approxOpBytes(batch []Element) int {
+	n := 0
+	for i := range batch {
+		n += len(batch[i].Text) + 64 // rough per-op overhead for the other fields
+	}
+	return n
+}
+
 type NoCRDTError string
 
 func (e NoCRDTError) Error() string {
@@ -112,14 +312,16 @@ func main() {
 	gob.Register([]Element{})
 	gob.Register(&Element{})
 	gob.Register(&CRDT{})
+	gob.Register(&revdialAddr{})
 	worker := new(Worker)
-	worker.logger = log.New(os.Stdout, "[Initializing] ", log.Lshortfile)
 	worker.init()
 	worker.listenRPC()
 	worker.listenHTTP()
 	worker.registerWithLB()
 	worker.getWorkers()
-	go worker.sendLocalOps()
+	go worker.maintainPeerConnections()
+	go worker.runAntiEntropy()
+	go worker.runCompactionGC()
 	worker.workerPrompt()
 	for {
 
@@ -127,9 +329,25 @@ func main() {
 }
 
 func (w *Worker) init() {
-	args := os.Args[1:]
+	nodeKeyPath := flag.String("nodekey", "", "path to this worker's ECDSA node identity key (PEM); generated if not set")
+	genKeyPath := flag.String("genkey", "", "write this worker's ECDSA node identity key (newly generated unless -nodekey is set) to this path")
+	logLevel := flag.String("loglevel", "info", "minimum log level: debug, info, warn, error")
+	flag.Parse()
+	xlog.SetLevel(xlog.ParseLevel(*logLevel))
+	w.logger = xlog.Root().WithField("worker_id", "initializing")
+	args := flag.Args()
 	w.serverAddr = args[0]
-	w.workers = make(map[string]*rpc.Client)
+	// A worker that can't accept inbound connections (behind a NAT/firewall)
+	// is started with a second "revdial" arg and instead keeps a control
+	// connection open to the LB for it to dial back through.
+	w.unreachable = len(args) > 1 && args[1] == "revdial"
+	id, err := identity.Load(*nodeKeyPath, *genKeyPath)
+	checkError(err)
+	w.identity = id
+	w.acceptedFingerprints = make(map[string]bool)
+	w.workers = make(map[string]*transport.Session)
+	w.peerPush = make(map[string]*peerPush)
+	w.peerAcks = make(map[string]map[string]string)
 	w.crdt = make(map[string]*CRDT)
 	w.clients = make(map[string]*websocket.Conn)
 }
@@ -149,6 +367,12 @@ func (w *Worker) listenRPC() {
 	checkError(err)
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	checkError(err)
+	tlsListener := tls.NewListener(listener, &tls.Config{
+		Certificates:          []tls.Certificate{w.identity.Cert},
+		InsecureSkipVerify:    true, // no CA; verifyPeerFingerprint checks the LB-vouched fingerprint instead
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: w.verifyPeerFingerprint,
+	})
 	rpc.Register(w)
 	w.localRPCAddr = listener.Addr()
 	rpc.Register(w)
@@ -156,12 +380,78 @@ func (w *Worker) listenRPC() {
 	w.logger.Println("listening for RPC on: ", listener.Addr().String())
 	go func() {
 		for {
-			conn, _ := listener.Accept()
-			go rpc.ServeConn(conn)
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				continue
+			}
+			go w.serveInboundConn(conn)
 		}
 	}()
 }
 
+// verifyPeerFingerprint rejects any inbound RPC connection whose peer
+// certificate the LB hasn't vouched for. With no CA to validate a chain
+// against, this fingerprint check is what stands in for authentication.
+func (w *Worker) verifyPeerFingerprint(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("worker: peer presented no certificate")
+	}
+	fp := identity.FingerprintCert(rawCerts[0])
+	w.mu.Lock()
+	accepted := w.acceptedFingerprints[fp]
+	w.mu.Unlock()
+	if accepted {
+		return nil
+	}
+	return fmt.Errorf("worker: rejecting peer cert fingerprint %s, not vouched for by LB", fp)
+}
+
+// serveInboundConn tells apart a plain single-shot RPC connection (the LB
+// calling SendCRDT-style methods directly) from a peer worker's multiplexed
+// transport session by peeking for the workerMuxHandshake line that
+// connectToWorkers/BidirectionalSetup write before handing a conn to
+// transport.Client.
+func (w *Worker) serveInboundConn(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	peek, err := br.Peek(len(workerMuxHandshake))
+	if err == nil && string(peek) == workerMuxHandshake {
+		br.Discard(len(workerMuxHandshake))
+		session := transport.Server(&peekedConn{Conn: conn, r: br}, nil)
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go w.serveMuxStream(stream)
+		}
+	}
+	rpc.ServeConn(conn)
+}
+
+// serveMuxStream tells apart a peer's dedicated op-propagation stream (see
+// startOpPusher) from an ordinary one-shot RPC stream by peeking for
+// opStreamHandshake, the same trick serveInboundConn uses for
+// workerMuxHandshake one layer up.
+func (w *Worker) serveMuxStream(stream net.Conn) {
+	br := bufio.NewReader(stream)
+	peek, err := br.Peek(len(opStreamHandshake))
+	if err == nil && string(peek) == opStreamHandshake {
+		br.Discard(len(opStreamHandshake))
+		w.readOpStream(&peekedConn{Conn: stream, r: br})
+		return
+	}
+	rpc.ServeConn(stream)
+}
+
+// peekedConn lets a net.Conn whose first bytes were already consumed into a
+// bufio.Reader (to sniff the handshake) keep working as a normal net.Conn.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) { return p.r.Read(b) }
+
 func (w *Worker) listenHTTP() {
 	http.HandleFunc("/ws", w.wsHandler)
 	httpAddr, err := net.ResolveTCPAddr("tcp", w.externalIP)
@@ -174,16 +464,89 @@ func (w *Worker) listenHTTP() {
 }
 
 func (w *Worker) registerWithLB() {
-	loadBalancerConn, err := rpc.Dial("tcp", w.serverAddr)
+	// The LB's fingerprint isn't known yet, so this first handshake trusts
+	// whatever certificate it presents; every subsequent hop pins against a
+	// fingerprint the LB itself vouched for.
+	tlsConn, err := tls.Dial("tcp", w.serverAddr, w.identity.TLSConfig(""))
 	checkError(err)
+	loadBalancerConn := rpc.NewClient(tlsConn)
 	settings := new(WorkerNetSettings)
-	err = loadBalancerConn.Call("LBServer.RegisterNewWorker", &WorkerInfo{w.localRPCAddr, w.localHTTPAddr}, settings)
+	err = loadBalancerConn.Call("LBServer.RegisterNewWorker", &WorkerInfo{w.localRPCAddr, w.localHTTPAddr, w.unreachable, w.identity.Fingerprint()}, settings)
 	checkError(err)
 	w.settings = settings
 	w.workerID = settings.WorkerID
+	w.mu.Lock()
+	w.acceptedFingerprints[settings.LBFingerprint] = true
+	w.mu.Unlock()
 	go w.startHeartBeat()
-	w.logger.SetPrefix("[Worker: " + strconv.Itoa(w.workerID) + "] ")
+	w.logger = xlog.Root().WithField("worker_id", strconv.Itoa(w.workerID))
 	w.loadBalancerConn = loadBalancerConn
+	if w.unreachable {
+		go w.maintainControlChannel()
+	}
+}
+
+// maintainControlChannel keeps a dedicated TCP connection to the LB open so
+// it (or a peer worker relayed through it) can revdial.Dial back through it
+// to reach this worker. It reconnects and re-identifies by workerID so the
+// LB can resume routing DialThrough calls to the new socket.
+func (w *Worker) maintainControlChannel() {
+	for {
+		conn, err := tls.Dial("tcp", w.serverAddr, w.identity.TLSConfig(w.settings.LBFingerprint))
+		if err != nil {
+			w.logger.Println("revdial: failed to dial LB, retrying:", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if _, err := fmt.Fprintf(conn, "REVDIAL %d\n", w.workerID); err != nil {
+			w.logger.Println("revdial: failed to identify to LB, retrying:", err)
+			conn.Close()
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		w.revListener = revdial.NewListener(conn)
+		w.logger.Println("revdial: control channel established")
+		w.serveControlChannel()
+		w.logger.Println("revdial: control channel lost, reconnecting")
+	}
+}
+
+// serveControlChannel accepts peer connections dialed back through the
+// control channel, returning once the channel dies. connectToWorkers
+// TLS-wraps a revdial peer exactly like a direct one before writing
+// workerMuxHandshake, so each accepted conn is brought up through the same
+// TLS + mux dispatch as listenRPC's direct listener.
+func (w *Worker) serveControlChannel() {
+	go w.pingControlChannel(w.revListener)
+	for {
+		peerConn, err := w.revListener.Accept()
+		if err != nil {
+			return
+		}
+		tlsConn := tls.Server(peerConn, &tls.Config{
+			Certificates:          []tls.Certificate{w.identity.Cert},
+			InsecureSkipVerify:    true,
+			ClientAuth:            tls.RequireAnyClientCert,
+			VerifyPeerCertificate: w.verifyPeerFingerprint,
+		})
+		go w.serveInboundConn(tlsConn)
+	}
+}
+
+// pingControlChannel periodically pings the tunnel and tears it down if it
+// stops responding, so maintainControlChannel notices and reconnects.
+func (w *Worker) pingControlChannel(l *revdial.Listener) {
+	for {
+		time.Sleep(30 * time.Second)
+		if l != w.revListener {
+			return
+		}
+		if err := l.Ping(10 * time.Second); err != nil {
+			w.logger.Println("revdial: ping failed, closing control channel:", err)
+			l.Close()
+			return
+		}
+	}
 }
 
 func (w *Worker) startHeartBeat() {
@@ -197,43 +560,345 @@ func (w *Worker) startHeartBeat() {
 
 // Gets miners from server if below MinNumMinerConnections
 func (w *Worker) getWorkers() {
-	var addrSet []net.Addr
-	for workerAddr, workerCon := range w.workers {
-		isConnected := false
-		workerCon.Call("Worker.PingWorker", "", &isConnected)
-		if !isConnected {
-			delete(w.workers, workerAddr)
+	var nodes []NodeInfo
+	w.mu.Lock()
+	addrs := make([]string, 0, len(w.workers))
+	sessions := make([]*transport.Session, 0, len(w.workers))
+	for workerAddr, session := range w.workers {
+		addrs = append(addrs, workerAddr)
+		sessions = append(sessions, session)
+	}
+	w.mu.Unlock()
+	for i, session := range sessions {
+		var isConnected bool
+		if err := w.call(session, "Worker.PingWorker", "", &isConnected); err != nil || !isConnected {
+			session.Close()
+			w.mu.Lock()
+			delete(w.workers, addrs[i])
+			w.mu.Unlock()
+			w.dropPeerPush(addrs[i])
 		}
 	}
-	if len(w.workers) < int(w.settings.MinNumWorkerConnections) {
-		w.loadBalancerConn.Call("LBServer.GetNodes", w.workerID, &addrSet)
-		w.connectToWorkers(addrSet)
+	w.mu.Lock()
+	numWorkers := len(w.workers)
+	w.mu.Unlock()
+	if numWorkers < int(w.settings.MinNumWorkerConnections) {
+		w.loadBalancerConn.Call("LBServer.GetNodes", w.workerID, &nodes)
+		w.connectToWorkers(nodes)
 	}
 }
 
 func (w *Worker) getSession(sessionID string) {
 	response := new(WorkerResponse)
-	for _, workerCon := range w.workers {
-		err := workerCon.Call("Worker.SendCRDT", sessionID, response)
+	w.mu.Lock()
+	sessions := make([]*transport.Session, 0, len(w.workers))
+	for _, session := range w.workers {
+		sessions = append(sessions, session)
+	}
+	w.mu.Unlock()
+	for _, session := range sessions {
+		err := w.call(session, "Worker.SendCRDT", sessionID, response)
 		if err != nil {
 			fmt.Println(err)
 		} else {
+			w.mu.Lock()
 			w.crdt[sessionID] = response.Payload[0].(*CRDT)
+			w.mu.Unlock()
 			w.crdtPrompt(sessionID)
 			return
 		}
 	}
 }
 
+// call opens a fresh stream on session, runs one RPC over it with a plain
+// gob rpc.Client, and tears the stream down again. A large CRDT transfer on
+// one stream can no longer block a heartbeat on another because each call
+// gets its own stream rather than sharing one TCP connection.
+//
+// Each call is tagged with a locally generated request_id for log
+// correlation. Propagating that id to the peer as a real RPC header would
+// need a custom rpc.ClientCodec/ServerCodec - the plain gob codec this
+// project uses has no header slot of its own - so each hop only traces its
+// own side of a call. The op-propagation pipeline (readOpStream and
+// runOpPusher) carries no trace key across workers either: its log lines do
+// not include op IDs.
+func (w *Worker) call(session *transport.Session, serviceMethod string, args, reply interface{}) error {
+	xl := w.logger.WithField("rpc_method", serviceMethod).WithField("request_id", String(8))
+	stream, err := session.OpenStream()
+	if err != nil {
+		xl.Warnf("failed to open stream: %v", err)
+		return err
+	}
+	client := rpc.NewClient(stream)
+	defer client.Close()
+	if err := client.Call(serviceMethod, args, reply); err != nil {
+		xl.Debugf("call failed: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (w *Worker) SendCRDT(sessionID string, response *WorkerResponse) error {
-	if w.crdt[sessionID] == nil {
+	ctx := xlog.NewContext(context.Background(), w.logger.WithField("rpc_method", "SendCRDT").WithField("session_id", sessionID))
+	xl := xlog.FromContext(ctx)
+	w.mu.Lock()
+	crdt := w.crdt[sessionID]
+	w.mu.Unlock()
+	if crdt == nil {
+		xl.Warnf("no CRDT for requested session")
 		return NoCRDTError(sessionID)
 	}
 	response.Payload = make([]interface{}, 1)
-	response.Payload[0] = w.crdt[sessionID]
+	response.Payload[0] = crdt
+	xl.Debugf("sent CRDT snapshot")
+	return nil
+}
+
+// SyncSummaryReply is what SyncSummary hands back: enough to tell whether
+// two peers' CRDTs for a session already match without transferring either
+// one's full state.
+type SyncSummaryReply struct {
+	RootHash [32]byte
+	OpCount  int
+	MinOpID  string
+	MaxOpID  string
+}
+
+// SyncSummary answers the anti-entropy reconciler's first question about a
+// session: does my CRDT already match yours?
+func (w *Worker) SyncSummary(sessionID string, reply *SyncSummaryReply) error {
+	w.mu.Lock()
+	crdt := w.crdt[sessionID]
+	w.mu.Unlock()
+	if crdt == nil {
+		return NoCRDTError(sessionID)
+	}
+	crdt.mu.Lock()
+	reply.RootHash = crdt.RootHash
+	reply.OpCount = crdt.OpCount
+	reply.MinOpID = crdt.MinOpID
+	reply.MaxOpID = crdt.MaxOpID
+	crdt.mu.Unlock()
+	return nil
+}
+
+// fetchOpsSinceChunkSize bounds how many ops FetchOpsSince returns per call,
+// so a reconciler pulling a large divergent range does it over several
+// round trips instead of one unbounded transfer.
+const fetchOpsSinceChunkSize = 256
+
+// FetchOpsSinceArgs bundles FetchOpsSince's logical arguments into one,
+// since a net/rpc method takes a single args value.
+type FetchOpsSinceArgs struct {
+	SessionID string
+	Cursor    string // opID cursor; only ops with a strictly greater opID are returned, "" means from the start
+	// Buckets restricts the result to ops whose opBucket is in this set, so
+	// pullDivergentOps can page through just the buckets its bucket-hash
+	// comparison found divergent instead of the whole CRDT. Empty means no
+	// restriction.
+	Buckets []int
+}
+
+// FetchOpsSince returns sessionID's ops in ascending opID order, starting
+// just after args.Cursor and optionally restricted to args.Buckets, capped
+// at fetchOpsSinceChunkSize - the reconciler calls it repeatedly, advancing
+// the cursor each round, until it catches up.
+func (w *Worker) FetchOpsSince(args FetchOpsSinceArgs, reply *[]Element) error {
+	w.mu.Lock()
+	crdt := w.crdt[args.SessionID]
+	w.mu.Unlock()
+	if crdt == nil {
+		return NoCRDTError(args.SessionID)
+	}
+	var wantBuckets map[int]bool
+	if len(args.Buckets) > 0 {
+		wantBuckets = make(map[int]bool, len(args.Buckets))
+		for _, b := range args.Buckets {
+			wantBuckets[b] = true
+		}
+	}
+	crdt.mu.Lock()
+	var ops []Element
+	for _, e := range crdt.Elements {
+		if args.Cursor != "" && !opIDLess(args.Cursor, e.ID) {
+			continue
+		}
+		if wantBuckets != nil && !wantBuckets[opBucket(e.ID)] {
+			continue
+		}
+		ops = append(ops, *e)
+	}
+	crdt.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return opIDLess(ops[i].ID, ops[j].ID) })
+	if len(ops) > fetchOpsSinceChunkSize {
+		ops = ops[:fetchOpsSinceChunkSize]
+	}
+	*reply = ops
+	return nil
+}
+
+// BucketHashes returns the same per-bucket rolling hashes bucketHashes
+// computes locally for sessionID's current elements, so pullDivergentOps can
+// tell which buckets actually diverged before paging FetchOpsSince, instead
+// of transferring the whole CRDT to find out.
+func (w *Worker) BucketHashes(sessionID string, reply *map[int][32]byte) error {
+	w.mu.Lock()
+	crdt := w.crdt[sessionID]
+	w.mu.Unlock()
+	if crdt == nil {
+		return NoCRDTError(sessionID)
+	}
+	crdt.mu.Lock()
+	*reply = bucketHashes(crdt.Elements)
+	crdt.mu.Unlock()
+	return nil
+}
+
+// compactionInterval is how often the background GC pass checks for
+// tombstones every known peer has acked past and can now be spliced out.
+const compactionInterval = 20 * time.Second
+
+// CompactionRecord describes a tombstone splice: once a delete op has been
+// acked by every peer, the target element is spliced out of the linked list
+// and its neighbors repointed. Broadcasting this lets a late-joining peer
+// apply the same rewrite instead of re-deriving it from a delete op it may
+// never see directly.
+type CompactionRecord struct {
+	SessionID string
+	TargetID  string
+	NewPrevID string
+	NewNextID string
+	WasFirst  bool
+}
+
+// ApplyCompaction applies a peer's already-decided tombstone splice.
+func (w *Worker) ApplyCompaction(rec CompactionRecord, ignored *bool) error {
+	w.mu.Lock()
+	crdt := w.crdt[rec.SessionID]
+	w.mu.Unlock()
+	if crdt == nil {
+		return NoCRDTError(rec.SessionID)
+	}
+	crdt.mu.Lock()
+	defer crdt.mu.Unlock()
+	if rec.WasFirst {
+		crdt.CrdtFirstID = rec.NewNextID
+	} else if predecessor := crdt.Elements[rec.NewPrevID]; predecessor != nil {
+		predecessor.NextID = rec.NewNextID
+	}
+	if next := crdt.Elements[rec.NewNextID]; next != nil {
+		next.PrevID = rec.NewPrevID
+	}
+	delete(crdt.Elements, rec.TargetID)
 	return nil
 }
 
+// broadcastCompaction tells every peer we know about to apply a tombstone
+// splice we just decided locally; best-effort, same as broadcastOp - a peer
+// that misses it keeps its tombstone, since anti-entropy only pulls in ops a
+// replica lacks and never applies a splice.
+func (w *Worker) broadcastCompaction(rec CompactionRecord) {
+	w.mu.Lock()
+	sessions := make([]*transport.Session, 0, len(w.workers))
+	for _, session := range w.workers {
+		sessions = append(sessions, session)
+	}
+	w.mu.Unlock()
+	var ignored bool
+	for _, session := range sessions {
+		w.call(session, "Worker.ApplyCompaction", rec, &ignored)
+	}
+}
+
+// isAckedByAllPeers reports whether every peer we currently know about has
+// acked an opID at or past opID for sessionID, using the per-peer,
+// per-session ack cursor the event-driven op pipeline already maintains.
+// With no peers to confirm against, nothing is considered safe to compact
+// yet.
+func (w *Worker) isAckedByAllPeers(sessionID, opID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.workers) == 0 {
+		return false
+	}
+	for peerAddr := range w.workers {
+		acked, ok := w.peerAcks[peerAddr][sessionID]
+		if !ok || opIDLess(acked, opID) {
+			return false
+		}
+	}
+	return true
+}
+
+// spliceTombstone splices target out of crdt's linked list, rewriting its
+// neighbors' PrevID/NextID pointers (or CrdtFirstID, if target was first),
+// and returns the record of what it did so the caller can broadcast it once
+// it's safe to do so. Callers must hold crdt.mu.
+func (w *Worker) spliceTombstone(crdt *CRDT, target *Element) CompactionRecord {
+	rec := CompactionRecord{
+		SessionID: target.SessionID,
+		TargetID:  target.ID,
+		NewPrevID: target.PrevID,
+		NewNextID: target.NextID,
+		WasFirst:  target.ID == crdt.CrdtFirstID,
+	}
+	if rec.WasFirst {
+		crdt.CrdtFirstID = target.NextID
+	} else if predecessor := crdt.Elements[target.PrevID]; predecessor != nil {
+		predecessor.NextID = target.NextID
+	}
+	if next := crdt.Elements[target.NextID]; next != nil {
+		next.PrevID = target.PrevID
+	}
+	delete(crdt.Elements, target.ID)
+	return rec
+}
+
+// compactAckedTombstones finds every delete op crdt has applied and, for
+// each whose target is still linked in and has been acked by every current
+// peer, splices the tombstone out. The splicing itself happens under
+// crdt.mu, but broadcastCompaction's RPCs to every peer do not - crdt.mu
+// also guards addRight/deleteAt/getMessage, so holding it across a
+// synchronous, untimed network call to a slow or unreachable peer would
+// freeze local edits for the whole session until that call fails.
+func (w *Worker) compactAckedTombstones(crdt *CRDT) {
+	crdt.mu.Lock()
+	var recs []CompactionRecord
+	for _, op := range crdt.Elements {
+		if op.Type != DELETE {
+			continue
+		}
+		target := crdt.Elements[op.PrevID]
+		if target == nil || !target.Deleted {
+			continue // already compacted, or the target was already spliced out
+		}
+		if w.isAckedByAllPeers(op.SessionID, op.ID) {
+			recs = append(recs, w.spliceTombstone(crdt, target))
+		}
+	}
+	crdt.mu.Unlock()
+	for _, rec := range recs {
+		w.broadcastCompaction(rec)
+	}
+}
+
+// runCompactionGC periodically sweeps every session for tombstones that have
+// been acked by every peer and can now be spliced out of the linked list.
+func (w *Worker) runCompactionGC() {
+	for {
+		time.Sleep(compactionInterval)
+		w.mu.Lock()
+		crdts := make([]*CRDT, 0, len(w.crdt))
+		for _, crdt := range w.crdt {
+			crdts = append(crdts, crdt)
+		}
+		w.mu.Unlock()
+		for _, crdt := range crdts {
+			w.compactAckedTombstones(crdt)
+		}
+	}
+}
+
 //****POC CODE***//
 
 func (w *Worker) workerPrompt() {
@@ -250,11 +915,15 @@ func (w *Worker) workerPrompt() {
 // Iterate through the beginning of the CRDT to the end to show the message and
 // specify the mapping of each character
 func (w *Worker) getMessage(crdt *CRDT) string {
+	crdt.mu.Lock()
+	defer crdt.mu.Unlock()
 	var buffer bytes.Buffer
 	firstOp := crdt.Elements[crdt.CrdtFirstID]
 	for firstOp != nil {
-		fmt.Println(firstOp.ID, "->", firstOp.Text)
-		buffer.WriteString(firstOp.Text)
+		if !firstOp.Deleted {
+			fmt.Println(firstOp.ID, "->", firstOp.Text)
+			buffer.WriteString(firstOp.Text)
+		}
 		firstOp = crdt.Elements[firstOp.NextID]
 	}
 	return buffer.String()
@@ -277,14 +946,19 @@ func (w *Worker) handleIntroCommand(cmd string) int {
 
 func (w *Worker) newSession() {
 	sessionID := String(5)
-	w.crdt[sessionID] = &CRDT{make(map[string]*Element),"",1}
+	w.mu.Lock()
+	w.crdt[sessionID] = &CRDT{Elements: make(map[string]*Element), CrdtFirstID: "", NextOpNumber: 1}
+	w.mu.Unlock()
 	w.crdtPrompt(sessionID)
 }
 
 func (w *Worker) crdtPrompt(sessionID string) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		message := w.getMessage(w.crdt[sessionID])
+		w.mu.Lock()
+		crdt := w.crdt[sessionID]
+		w.mu.Unlock()
+		message := w.getMessage(crdt)
 		fmt.Println("SessionID:", sessionID)
 		fmt.Println("Message:", message)
 		fmt.Print("Worker> ")
@@ -304,6 +978,11 @@ func (w *Worker) handleCommand(cmd string) int {
 		if checkError(err) != nil {
 			return 0
 		}
+	case "deleteAt":
+		err := w.deleteAt(args[1], args[2])
+		if checkError(err) != nil {
+			return 0
+		}
 	case "exit":
 		return 1
 	default:
@@ -315,17 +994,62 @@ func (w *Worker) handleCommand(cmd string) int {
 
 // Adds a character to the right of the prevID specified in the args
 func (w *Worker) addRight(prevID, content, sessionID string) error {
-	if !w.prevIDExists(prevID, sessionID) {
+	w.mu.Lock()
+	crdt := w.crdt[sessionID]
+	w.mu.Unlock()
+	if crdt == nil {
+		return nil
+	}
+	crdt.mu.Lock()
+	if !w.prevIDExists(prevID, crdt) {
+		crdt.mu.Unlock()
 		return nil
 	}
-	crdt := w.crdt[sessionID]
 	opID := strconv.Itoa(crdt.NextOpNumber) + strconv.Itoa(w.workerID)
-	newElement := &Element{sessionID, strconv.Itoa(w.workerID), false, opID, prevID, "", content}
+	newElement := &Element{SessionID: sessionID, ClientID: strconv.Itoa(w.workerID), Deleted: false, ID: opID, PrevID: prevID, NextID: "", Text: content, Type: INSERT}
 	w.addToCRDT(newElement, crdt)
+	broadcast := *crdt.Elements[opID]
+	crdt.mu.Unlock()
+	w.broadcastOp(broadcast)
 	return nil
 }
 
+// Marks the element identified by targetID as deleted. The node stays in the
+// CRDT and the linked list - only its Deleted flag flips - so a remote
+// insert whose PrevID points at it still resolves; compactAckedTombstones
+// splices it out later, once every peer has acked the delete.
+func (w *Worker) deleteAt(targetID, sessionID string) error {
+	w.mu.Lock()
+	crdt := w.crdt[sessionID]
+	w.mu.Unlock()
+	if crdt == nil {
+		return NoCRDTError(sessionID)
+	}
+	crdt.mu.Lock()
+	if crdt.Elements[targetID] == nil {
+		crdt.mu.Unlock()
+		return fmt.Errorf("no element [%s] in session [%s]", targetID, sessionID)
+	}
+	opID := strconv.Itoa(crdt.NextOpNumber) + strconv.Itoa(w.workerID)
+	delOp := &Element{SessionID: sessionID, ClientID: strconv.Itoa(w.workerID), Deleted: true, ID: opID, PrevID: targetID, NextID: "", Text: "", Type: DELETE}
+	if err := w.addToCRDT(delOp, crdt); err != nil {
+		crdt.mu.Unlock()
+		return err
+	}
+	broadcast := *crdt.Elements[opID]
+	crdt.mu.Unlock()
+	w.broadcastOp(broadcast)
+	return nil
+}
+
+// addToCRDT applies newElement to crdt. Callers must hold crdt.mu - it's
+// called both from local edits (addRight/deleteAt) and from remote ops
+// arriving via ApplyIncomingOps/pullDivergentOps, which all share the same
+// *CRDT with the pusher/anti-entropy/compaction goroutines.
 func (w *Worker) addToCRDT(newElement *Element, crdt *CRDT) error {
+	if newElement.Type == DELETE {
+		return w.applyDelete(newElement, crdt)
+	}
 	if w.firstCRDTEntry(newElement.ID, crdt) {
 		w.addOpAndIncrementCounter(newElement, newElement.ID, crdt)
 		return nil
@@ -339,18 +1063,27 @@ func (w *Worker) addToCRDT(newElement *Element, crdt *CRDT) error {
 	return nil
 }
 
-// Check if the prevID actually exists; if true, continue with addRight
-func (w *Worker) prevIDExists(prevID, sessionID string) bool {
-	crdt := w.crdt[sessionID]
-	if crdt != nil {
-		if _, ok := crdt.Elements[prevID]; ok || prevID == INITIAL_ID {
-			return true
-		} else {
-			return false
-		}
-	} else {
-		return false
+// applyDelete tombstones the element a DELETE op targets. The op reuses
+// PrevID to carry the target's opID rather than a list position, since a
+// delete doesn't get a place of its own in the linked list; the target stays
+// linked in so a remote insert whose PrevID still points at it resolves. The
+// delete op itself is recorded under its own opID so it replicates and
+// participates in the CRDT's anti-entropy summary like any other op.
+func (w *Worker) applyDelete(newElement *Element, crdt *CRDT) error {
+	target := crdt.Elements[newElement.PrevID]
+	if target == nil {
+		return fmt.Errorf("no element [%s] to delete in session [%s]", newElement.PrevID, newElement.SessionID)
 	}
+	target.Deleted = true
+	w.addOpAndIncrementCounter(newElement, newElement.ID, crdt)
+	return nil
+}
+
+// Check if the prevID actually exists; if true, continue with addRight.
+// Callers must hold crdt.mu.
+func (w *Worker) prevIDExists(prevID string, crdt *CRDT) bool {
+	_, ok := crdt.Elements[prevID]
+	return ok || prevID == INITIAL_ID
 }
 
 // The case where the first content is entered into a CRDT
@@ -387,14 +1120,16 @@ func (w *Worker) normalInsert(newElement *Element, prevID, opID string, crdt *CR
 
 // Checks if any other clients have made inserts to the same prevID. The algorithm
 // compares the prevOp's nextID to the incomingOp ID - if nextID is greater, incomingOp
-// will move further down the message until it is greater than the nextID
+// will move further down the message until it is greater than the nextID. A
+// tombstoned node in between never stops the walk on its own - its ClientID
+// is ignored - since it's a dead placeholder, not a real conflicting insert.
 func (w *Worker) samePlaceInsertCheck(newElement *Element, prevID, opID string, crdt *CRDT) string {
 	var nextOpID int
 	prevOp := crdt.Elements[prevID]
 	if prevOp.NextID != "" {
 		nextOpID, _ = strconv.Atoi(prevOp.NextID)
 		newOpID, _ := strconv.Atoi(opID)
-		for nextOpID >= newOpID && newElement.ClientID != crdt.Elements[prevOp.NextID].ClientID {
+		for nextOpID >= newOpID && (crdt.Elements[prevOp.NextID].Deleted || newElement.ClientID != crdt.Elements[prevOp.NextID].ClientID) {
 			prevOp = crdt.Elements[strconv.Itoa(nextOpID)]
 			nextOpID, _ = strconv.Atoi(prevOp.NextID)
 		}
@@ -408,83 +1143,512 @@ func (w *Worker) samePlaceInsertCheck(newElement *Element, prevID, opID string,
 // Once all the CRDT pointers are updated, the op can be added to the CRDT and the op
 // number can be incremented
 func (w *Worker) addOpAndIncrementCounter(newElement *Element, opID string, crdt *CRDT) {
-	deepCopyOp := &Element{newElement.SessionID, newElement.ClientID, newElement.Deleted, newElement.ID, newElement.PrevID, newElement.NextID, newElement.Text}
+	deepCopyOp := &Element{SessionID: newElement.SessionID, ClientID: newElement.ClientID, Deleted: newElement.Deleted, ID: newElement.ID, PrevID: newElement.PrevID, NextID: newElement.NextID, Text: newElement.Text, Type: newElement.Type}
 	crdt.Elements[opID] = deepCopyOp
-	w.localOps = append(w.localOps, *deepCopyOp)
+	w.updateCRDTSummary(crdt, deepCopyOp)
 	fmt.Println(crdt.NextOpNumber)
 	crdt.NextOpNumber++
 }
 
-// Establishes RPC connections with workers in addrs array
-func (w *Worker) connectToWorkers(addrs []net.Addr) {
-	for _, workerAddr := range addrs {
-		if w.workers[workerAddr.String()] == nil {
-			workerCon, err := rpc.Dial("tcp", workerAddr.String())
-			if err != nil {
-				w.logger.Println(err)
-				delete(w.workers, workerAddr.String())
-			} else {
-				w.workers[workerAddr.String()] = workerCon
-				response := new(WorkerResponse)
-				request := new(WorkerRequest)
-				request.Payload = make([]interface{}, 1)
-				request.Payload[0] = w.localRPCAddr.String()
-				workerCon.Call("Worker.BidirectionalSetup", request, response)
+// updateCRDTSummary folds a newly applied op into crdt's rolling
+// anti-entropy summary: an order-independent XOR-of-SHA256 hash plus the op
+// count and numeric opID bounds, so SyncSummary can tell two peers' CRDTs
+// apart (or confirm they match) without either side sending its full state.
+func (w *Worker) updateCRDTSummary(crdt *CRDT, e *Element) {
+	crdt.RootHash = xorHash(crdt.RootHash, elementHash(e))
+	crdt.OpCount++
+	if crdt.MinOpID == "" || opIDLess(e.ID, crdt.MinOpID) {
+		crdt.MinOpID = e.ID
+	}
+	if crdt.MaxOpID == "" || opIDLess(crdt.MaxOpID, e.ID) {
+		crdt.MaxOpID = e.ID
+	}
+}
+
+// elementHash is the per-op input to a CRDT's rolling XOR hash: hashing
+// (ID, PrevID, Text, Deleted) means two peers that applied the same ops in
+// a different order still end up with identical RootHash values.
+func elementHash(e *Element) [32]byte {
+	return sha256.Sum256([]byte(e.ID + "\x00" + e.PrevID + "\x00" + e.Text + "\x00" + strconv.FormatBool(e.Deleted)))
+}
+
+func xorHash(a, b [32]byte) [32]byte {
+	var out [32]byte
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// opIDLess compares two opIDs numerically - opIDs are produced by
+// concatenating NextOpNumber and workerID as digits (see addRight) and
+// parsed back the same way samePlaceInsertCheck already does.
+func opIDLess(a, b string) bool {
+	an, _ := strconv.Atoi(a)
+	bn, _ := strconv.Atoi(b)
+	return an < bn
+}
+
+// broadcastOp fans a just-applied op out to every peer's ring buffer instead
+// of batching it into one shared slice for a periodic flush; each peer's
+// pusher goroutine (see startOpPusher) picks it up off its own ring and
+// ships it on its own dedicated stream, so one slow peer can't hold back
+// delivery to the others. Only ops this worker originated are broadcast -
+// ApplyIncomingOps applies a peer's ops without re-broadcasting them, or
+// every op would ping-pong around the mesh forever.
+func (w *Worker) broadcastOp(op Element) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, p := range w.peerPush {
+		p.ring.push(op)
+	}
+}
+
+// startOpPusher registers peerAddr's ring buffer and dedicated stream and
+// launches the goroutine that drains one onto the other.
+func (w *Worker) startOpPusher(peerAddr string, stream net.Conn) {
+	p := &peerPush{stream: stream, ring: newOpRing()}
+	w.mu.Lock()
+	w.peerPush[peerAddr] = p
+	w.mu.Unlock()
+	go w.runOpPusher(peerAddr, p)
+}
+
+// dropPeerPush tears down peerAddr's op-propagation pipeline once its
+// session is gone; a reconnect calls startOpPusher again with a fresh ring.
+func (w *Worker) dropPeerPush(peerAddr string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p := w.peerPush[peerAddr]; p != nil {
+		p.stream.Close()
+		delete(w.peerPush, peerAddr)
+	}
+	delete(w.peerAcks, peerAddr)
+}
+
+// runOpPusher drains p's ring and ships batches down its dedicated stream,
+// coalescing whatever arrives within opBatchCoalesceWindow but flushing
+// immediately once a batch crosses opBatchByteThreshold. It also reads back
+// the peer's acks off the same (bidirectional) stream.
+func (w *Worker) runOpPusher(peerAddr string, p *peerPush) {
+	enc := gob.NewEncoder(p.stream)
+	go w.readOpAcks(peerAddr, p.stream)
+	for range p.ring.signal {
+		batch, pooled := p.ring.drain()
+		if len(batch) == 0 {
+			continue
+		}
+		coalesce := time.NewTimer(opBatchCoalesceWindow)
+	collect:
+		for approxOpBytes(batch) < opBatchByteThreshold {
+			select {
+			case <-p.ring.signal:
+				more, morePooled := p.ring.drain()
+				if len(more) > 0 {
+					if !pooled {
+						scratch := opBatchPool.Get().([]Element)[:0]
+						batch = append(scratch, batch...)
+						pooled = true
+					}
+					batch = append(batch, more...)
+					if morePooled {
+						opBatchPool.Put(more[:0])
+					}
+				}
+			case <-coalesce.C:
+				break collect
 			}
 		}
+		coalesce.Stop()
+		err := enc.Encode(opStreamMsg{Type: opMsgData, Ops: batch})
+		if pooled {
+			opBatchPool.Put(batch[:0])
+		}
+		if err != nil {
+			w.logger.Println("worker: op stream to", peerAddr, "failed, will resync via anti-entropy:", err)
+			return
+		}
 	}
 }
 
+// readOpAcks reads the peer's per-session acks off the pusher's own stream
+// into peerAcks, where isAckedByAllPeers checks them before compaction.
+// dropPeerPush discards a peer's acks along with its pipeline, and nothing
+// is replayed from them on reconnect: a reconnected peer gets only ops
+// broadcast after its new pusher starts.
+func (w *Worker) readOpAcks(peerAddr string, stream net.Conn) {
+	dec := gob.NewDecoder(stream)
+	for {
+		var msg opStreamMsg
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Type == opMsgAck {
+			w.mu.Lock()
+			acks := w.peerAcks[peerAddr]
+			if acks == nil {
+				acks = make(map[string]string)
+				w.peerAcks[peerAddr] = acks
+			}
+			for sessionID, opID := range msg.Acks {
+				acks[sessionID] = opID
+			}
+			w.mu.Unlock()
+		}
+	}
+}
 
-func (w *Worker) sendLocalOps() error {
+// readOpStream is the receiving side of a peer's dedicated op stream: it
+// decodes batches as they arrive and applies them via ApplyIncomingOps,
+// acking the last op ID applied per session back over the same stream.
+func (w *Worker) readOpStream(stream net.Conn) {
+	dec := gob.NewDecoder(stream)
+	enc := gob.NewEncoder(stream)
 	for {
-		time.Sleep(time.Second * 10)
-		// w.getWorkers() // checks all workers, connects to more if needed
-		request := new(WorkerRequest)
-		request.Payload = make([]interface{}, 1)
-		request.Payload[0] = w.localOps
+		var msg opStreamMsg
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Type != opMsgData {
+			continue
+		}
+		lastApplied := w.ApplyIncomingOps(msg.Ops)
+		if len(lastApplied) > 0 {
+			enc.Encode(opStreamMsg{Type: opMsgAck, Acks: lastApplied})
+		}
+	}
+}
+
+// Establishes a muxed, TLS-authenticated transport session with each peer in
+// nodes that we don't already have one for, verifying its certificate
+// against the fingerprint the LB vouched for.
+func (w *Worker) connectToWorkers(nodes []NodeInfo) {
+	for _, node := range nodes {
+		workerAddr := node.Addr
+		w.mu.Lock()
+		alreadyConnected := w.workers[workerAddr.String()] != nil
+		w.mu.Unlock()
+		if alreadyConnected {
+			continue
+		}
+		revAddr, isRevdial := workerAddr.(*revdialAddr)
+		var rawConn net.Conn
+		var err error
+		if isRevdial {
+			rawConn, err = w.dialThroughLB(revAddr.WorkerID)
+		} else {
+			rawConn, err = net.Dial("tcp", workerAddr.String())
+		}
+		if err != nil {
+			w.logger.Println(err)
+			w.mu.Lock()
+			delete(w.workers, workerAddr.String())
+			w.mu.Unlock()
+			continue
+		}
+		conn := tls.Client(rawConn, w.identity.TLSConfig(node.Fingerprint))
+		if err := conn.Handshake(); err != nil {
+			w.logger.Println("worker: TLS handshake with peer failed:", err)
+			conn.Close()
+			continue
+		}
+		if _, err := io.WriteString(conn, workerMuxHandshake); err != nil {
+			w.logger.Println(err)
+			conn.Close()
+			continue
+		}
+		session := transport.Client(conn, nil)
+		w.mu.Lock()
+		w.acceptedFingerprints[node.Fingerprint] = true
+		w.workers[workerAddr.String()] = session
+		w.mu.Unlock()
+		w.openOpStream(workerAddr.String(), session)
+		if isRevdial {
+			// The peer can't accept an inbound dial from us, so there's
+			// nothing useful to hand it in BidirectionalSetup - it already
+			// reaches us the same way, via the LB's revdial tunnel.
+			continue
+		}
 		response := new(WorkerResponse)
-		for workerAddr, workerCon := range w.workers {
-			isConnected := false
-			workerCon.Call("Worker.PingWorker", "", &isConnected)
-			if isConnected {
-				workerCon.Call("Worker.ApplyIncomingOps", request, response)
-			} else {
-				delete(w.workers, workerAddr)
-			}
+		request := new(WorkerRequest)
+		request.Payload = []interface{}{w.localRPCAddr.String(), w.identity.Fingerprint()}
+		w.call(session, "Worker.BidirectionalSetup", request, response)
+	}
+}
+
+// openOpStream opens peerAddr's dedicated op-propagation stream and starts
+// its pusher goroutine; failures just get logged, since the peer is still
+// reachable for everything else and anti-entropy can catch it up later.
+func (w *Worker) openOpStream(peerAddr string, session *transport.Session) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		w.logger.Println("worker: failed to open op stream to", peerAddr, ":", err)
+		return
+	}
+	if _, err := io.WriteString(stream, opStreamHandshake); err != nil {
+		w.logger.Println("worker: failed to identify op stream to", peerAddr, ":", err)
+		stream.Close()
+		return
+	}
+	w.startOpPusher(peerAddr, stream)
+}
+
+// dialThroughLB asks the LB to dial workerID back through that worker's
+// revdial control channel and hand us a local address to connect to; the LB
+// proxies bytes between that address and the tunnel.
+func (w *Worker) dialThroughLB(workerID int) (net.Conn, error) {
+	var proxyAddr string
+	if err := w.loadBalancerConn.Call("LBServer.DialThrough", workerID, &proxyAddr); err != nil {
+		return nil, err
+	}
+	return net.Dial("tcp", proxyAddr)
+}
+
+// maintainPeerConnections periodically checks peer liveness and connects to
+// more workers if we're below the configured minimum. Op replication no
+// longer waits on this loop - broadcastOp ships a new op to every peer's
+// ring the moment it's applied - so this just keeps the mesh itself healthy.
+func (w *Worker) maintainPeerConnections() {
+	for {
+		time.Sleep(time.Second * 10)
+		w.getWorkers()
+	}
+}
+
+// reconcileInterval is how often the anti-entropy reconciler compares
+// state with a random peer - frequent enough to catch up quickly after a
+// missed push, infrequent enough not to matter if sessions are large.
+const reconcileInterval = 15 * time.Second
+
+// opBucketCount is how many opID buckets pullDivergentOps hashes a
+// session's ops into while walking a diverged range, so it pulls only the
+// buckets whose hashes differ.
+const opBucketCount = 16
+
+// runAntiEntropy periodically reconciles every session against a random
+// peer, so ops survive a push that silently failed (sendLocalOps used to
+// just drop them) and a rejoining worker catches up without transferring a
+// whole CRDT via SendCRDT.
+func (w *Worker) runAntiEntropy() {
+	for {
+		time.Sleep(reconcileInterval)
+		w.reconcileWithRandomPeer()
+	}
+}
+
+// randomPeerSession picks one of this worker's current peer sessions at
+// random for the anti-entropy reconciler to compare against; nil if there
+// are none.
+func (w *Worker) randomPeerSession() *transport.Session {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.workers) == 0 {
+		return nil
+	}
+	i := rand.Intn(len(w.workers))
+	for _, session := range w.workers {
+		if i == 0 {
+			return session
 		}
-		w.localOps = nil
+		i--
 	}
 	return nil
 }
 
-func (w *Worker) ApplyIncomingOps(request *WorkerRequest, response *WorkerResponse) error {
-	incomingOps := request.Payload[0].([]Element)
-	for _, op := range incomingOps {
+// reconcileWithRandomPeer compares every local session's summary against
+// one randomly chosen peer and pulls anything that diverged.
+func (w *Worker) reconcileWithRandomPeer() {
+	session := w.randomPeerSession()
+	if session == nil {
+		return
+	}
+	w.mu.Lock()
+	sessionIDs := make([]string, 0, len(w.crdt))
+	crdts := make([]*CRDT, 0, len(w.crdt))
+	for sessionID, crdt := range w.crdt {
+		sessionIDs = append(sessionIDs, sessionID)
+		crdts = append(crdts, crdt)
+	}
+	w.mu.Unlock()
+	for i, sessionID := range sessionIDs {
+		crdt := crdts[i]
+		var remote SyncSummaryReply
+		if err := w.call(session, "Worker.SyncSummary", sessionID, &remote); err != nil {
+			continue
+		}
+		crdt.mu.Lock()
+		converged := remote.RootHash == crdt.RootHash && remote.OpCount == crdt.OpCount
+		crdt.mu.Unlock()
+		if converged {
+			continue
+		}
+		w.pullDivergentOps(session, sessionID, crdt)
+	}
+}
+
+// opBucket returns which of opBucketCount buckets an opID falls into.
+func opBucket(opID string) int {
+	n, _ := strconv.Atoi(opID)
+	if n < 0 {
+		n = -n
+	}
+	return n % opBucketCount
+}
+
+// bucketHashes computes the per-bucket rolling hash of a set of elements -
+// the same XOR-of-SHA256 a CRDT's RootHash is built from, just split by
+// opBucket so pullDivergentOps can find which range of the op space
+// actually diverged and fetch only that.
+func bucketHashes(elements map[string]*Element) map[int][32]byte {
+	hashes := make(map[int][32]byte)
+	for id, e := range elements {
+		b := opBucket(id)
+		hashes[b] = xorHash(hashes[b], elementHash(e))
+	}
+	return hashes
+}
+
+// pullDivergentOps compares our bucket hashes against the peer's to find
+// which ranges of the op space actually diverged, then pages FetchOpsSince
+// restricted to just those buckets, merging in anything we don't already
+// have. This is what keeps anti-entropy from re-transferring the whole CRDT
+// every time a summary mismatches - only the divergent buckets cross the
+// wire, not every op.
+func (w *Worker) pullDivergentOps(session *transport.Session, sessionID string, crdt *CRDT) {
+	crdt.mu.Lock()
+	localBuckets := bucketHashes(crdt.Elements)
+	crdt.mu.Unlock()
+
+	var remoteBuckets map[int][32]byte
+	if err := w.call(session, "Worker.BucketHashes", sessionID, &remoteBuckets); err != nil {
+		return
+	}
+
+	seen := make(map[int]bool, len(localBuckets))
+	var divergent []int
+	for b, h := range localBuckets {
+		seen[b] = true
+		if remoteBuckets[b] != h {
+			divergent = append(divergent, b)
+		}
+	}
+	var zero [32]byte
+	for b, h := range remoteBuckets {
+		if !seen[b] && h != zero {
+			divergent = append(divergent, b)
+		}
+	}
+	if len(divergent) == 0 {
+		return
+	}
+	w.logger.Println("worker: anti-entropy for session", sessionID, "pulling divergent buckets", divergent)
+
+	cursor := ""
+	for {
+		args := FetchOpsSinceArgs{SessionID: sessionID, Cursor: cursor, Buckets: divergent}
+		var ops []Element
+		if err := w.call(session, "Worker.FetchOpsSince", args, &ops); err != nil || len(ops) == 0 {
+			break
+		}
+		crdt.mu.Lock()
+		for i := range ops {
+			op := ops[i]
+			if crdt.Elements[op.ID] == nil {
+				e := elementPool.Get().(*Element)
+				*e = op
+				w.addToCRDT(e, crdt)
+				elementPool.Put(e)
+			}
+			cursor = op.ID
+		}
+		crdt.mu.Unlock()
+		if len(ops) < fetchOpsSinceChunkSize {
+			break
+		}
+	}
+}
+
+// ApplyIncomingOps applies a batch of ops that just arrived on a peer's
+// dedicated op stream (see readOpStream), reusing a pooled *Element rather
+// than allocating one per op since addToCRDT only ever reads it into its
+// own deep copy. A single batch can interleave ops from several sessions -
+// the pusher's ring is shared per peer, not per session - so it returns the
+// last op ID handled per session, keyed by sessionID, so the caller can ack
+// each session back to the sender separately. Ops for a session this worker
+// has no CRDT for are dropped but still counted there.
+func (w *Worker) ApplyIncomingOps(ops []Element) (lastApplied map[string]string) {
+	if len(ops) == 0 {
+		return nil
+	}
+	lastApplied = make(map[string]string)
+	ctx := xlog.NewContext(context.Background(), w.logger.WithField("rpc_method", "ApplyIncomingOps").WithField("session_id", ops[0].SessionID))
+	xl := xlog.FromContext(ctx)
+	for i := range ops {
+		op := ops[i]
+		w.mu.Lock()
 		crdt := w.crdt[op.SessionID]
+		w.mu.Unlock()
 		if crdt != nil {
+			crdt.mu.Lock()
 			if crdt.Elements[op.ID] == nil {
-				w.addToCRDT(&op, crdt)
+				e := elementPool.Get().(*Element)
+				*e = op
+				w.addToCRDT(e, crdt)
+				elementPool.Put(e)
 			}
+			crdt.mu.Unlock()
 		}
+		lastApplied[op.SessionID] = op.ID
 	}
-	return nil
+	xl.Debugf("applied %d incoming ops across %d sessions", len(ops), len(lastApplied))
+	return lastApplied
 }
 
 func (w *Worker) BidirectionalSetup(request *WorkerRequest, response *WorkerResponse) error {
 	workerAddr := request.Payload[0].(string)
-	workerConn, err := rpc.Dial("tcp", workerAddr)
+	requesterFingerprint := request.Payload[1].(string)
+	ctx := xlog.NewContext(context.Background(), w.logger.WithField("rpc_method", "BidirectionalSetup").WithField("remote_addr", workerAddr))
+	xl := xlog.FromContext(ctx)
+	rawConn, err := net.Dial("tcp", workerAddr)
 	if err != nil {
+		xl.Warnf("dial back to requester failed: %v", err)
+		w.mu.Lock()
 		delete(w.workers, workerAddr)
-	} else {
-		w.workers[workerAddr] = workerConn
+		w.mu.Unlock()
+		return nil
+	}
+	conn := tls.Client(rawConn, w.identity.TLSConfig(requesterFingerprint))
+	if err := conn.Handshake(); err != nil {
+		xl.Warnf("TLS handshake with requester failed: %v", err)
+		conn.Close()
+		w.mu.Lock()
+		delete(w.workers, workerAddr)
+		w.mu.Unlock()
+		return nil
+	}
+	if _, err := io.WriteString(conn, workerMuxHandshake); err != nil {
+		xl.Warnf("failed to identify mux session to requester: %v", err)
+		conn.Close()
+		w.mu.Lock()
+		delete(w.workers, workerAddr)
+		w.mu.Unlock()
+		return nil
 	}
+	session := transport.Client(conn, nil)
+	w.mu.Lock()
+	w.acceptedFingerprints[requesterFingerprint] = true
+	w.workers[workerAddr] = session
+	w.mu.Unlock()
+	w.openOpStream(workerAddr, session)
+	xl.Infof("bidirectional session established")
 	return nil
 }
 
 // Pings all workers currently listed in the worker map
 // If a connected worker fails to reply, that worker should be removed from the map
 func (w *Worker) PingWorker(payload string, reply *bool) error {
+	ctx := xlog.NewContext(context.Background(), w.logger.WithField("rpc_method", "PingWorker"))
+	xlog.FromContext(ctx).Debugf("ping")
 	*reply = true
 	return nil
 }
@@ -504,7 +1668,8 @@ func (w *Worker) wsHandler(wr http.ResponseWriter, r *http.Request) {
 	if len(userID) == 0 {
 		http.Error(wr, "Missing userID in URL parameter", http.StatusBadRequest)
 	}
-	w.logger.Println("New socket connection from: ", userID)
+	ctx := xlog.NewContext(context.Background(), w.logger.WithField("rpc_method", "wsHandler").WithField("client_id", userID[0]).WithField("remote_addr", r.RemoteAddr))
+	xlog.FromContext(ctx).Infof("new socket connection")
 	w.clients[userID[0]] = conn
 	go w.reader(conn, userID[0])
 }
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+// cloneCRDT deep-copies a CRDT's Elements so two replicas can branch from
+// the same ancestor state and diverge independently, the way two peers'
+// local copies of a session actually do.
+func cloneCRDT(c *CRDT) *CRDT {
+	clone := &CRDT{
+		Elements:     make(map[string]*Element, len(c.Elements)),
+		CrdtFirstID:  c.CrdtFirstID,
+		NextOpNumber: c.NextOpNumber,
+		RootHash:     c.RootHash,
+		OpCount:      c.OpCount,
+		MinOpID:      c.MinOpID,
+		MaxOpID:      c.MaxOpID,
+	}
+	for id, e := range c.Elements {
+		copied := *e
+		clone.Elements[id] = &copied
+	}
+	return clone
+}
+
+// TestConcurrentDeleteAndInsertAtSamePrevIDConverge makes a delete of a
+// character and an insert of a new character right after it on replica A -
+// both targeting the same prevID - and applies the resulting ops in
+// opposite orders on two independent replicas. Both
+// must converge to the same message and the same tombstoned/rolling-hash
+// state regardless of which op landed first.
+func TestConcurrentDeleteAndInsertAtSamePrevIDConverge(t *testing.T) {
+	const sid = "sess1"
+
+	base := &CRDT{Elements: make(map[string]*Element), NextOpNumber: 1}
+	seed := &Worker{workerID: 1, crdt: map[string]*CRDT{sid: base}}
+	if err := seed.addRight(INITIAL_ID, "a", sid); err != nil {
+		t.Fatalf("seeding base CRDT: %v", err)
+	}
+
+	crdtA := cloneCRDT(base)
+	crdtB := cloneCRDT(base)
+	wA := &Worker{workerID: 1, crdt: map[string]*CRDT{sid: crdtA}}
+	wB := &Worker{workerID: 2, crdt: map[string]*CRDT{sid: crdtB}}
+
+	// Replica A applies its own delete and insert locally, in that order.
+	if err := wA.deleteAt("11", sid); err != nil {
+		t.Fatalf("deleteAt on replica A: %v", err)
+	}
+	if err := wA.addRight("11", "b", sid); err != nil {
+		t.Fatalf("addRight on replica A: %v", err)
+	}
+
+	// Replica B receives the same two ops as if they came in over the wire
+	// out of order - the insert before the delete - exactly like
+	// ApplyIncomingOps/pullDivergentOps apply a remote op directly.
+	insertOp := *crdtA.Elements["31"]
+	deleteOp := *crdtA.Elements["21"]
+	if err := wB.addToCRDT(&insertOp, crdtB); err != nil {
+		t.Fatalf("applying remote insert to replica B: %v", err)
+	}
+	if err := wB.addToCRDT(&deleteOp, crdtB); err != nil {
+		t.Fatalf("applying remote delete to replica B: %v", err)
+	}
+
+	msgA, msgB := wA.getMessage(crdtA), wB.getMessage(crdtB)
+	if msgA != msgB {
+		t.Fatalf("replicas diverged: A=%q B=%q", msgA, msgB)
+	}
+	if msgA != "b" {
+		t.Fatalf("expected tombstoned char to be skipped, got %q", msgA)
+	}
+	if !crdtA.Elements["11"].Deleted || !crdtB.Elements["11"].Deleted {
+		t.Fatalf("target element should be tombstoned, not unlinked, on both replicas")
+	}
+	if crdtA.RootHash != crdtB.RootHash {
+		t.Fatalf("rolling hash should converge regardless of apply order")
+	}
+}
+
+// TestSamePlaceInsertCheckSkipsTombstones exercises the walk directly: a
+// tombstoned node sharing the incoming op's ClientID must not stop the walk
+// early just because the client IDs happen to match, or a same-place insert
+// can land before a deleted node instead of after it.
+func TestSamePlaceInsertCheckSkipsTombstones(t *testing.T) {
+	crdt := &CRDT{Elements: map[string]*Element{
+		"10": {ID: "10", ClientID: "1", NextID: "20"},
+		"20": {ID: "20", ClientID: "2", NextID: "30", Deleted: true},
+		"30": {ID: "30", ClientID: "2", NextID: ""},
+	}}
+	w := &Worker{workerID: 1, crdt: map[string]*CRDT{"sid": crdt}}
+	newElement := &Element{ClientID: "2"}
+
+	got := w.samePlaceInsertCheck(newElement, "10", "15", crdt)
+	if got != "20" {
+		t.Fatalf("expected walk to skip the tombstoned node and anchor at \"20\", got %q", got)
+	}
+}
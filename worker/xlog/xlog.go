@@ -0,0 +1,175 @@
+// Package xlog is a small structured logger that carries key/value context
+// (worker_id, session_id, client_id, op_id, remote_addr, rpc_method, ...)
+// through a context.Context, so an operator can grep a single session_id
+// across many worker processes to debug convergence issues. It emits JSON
+// lines by default and falls back to a human-readable line when its output
+// is a TTY.
+package xlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is a logger's minimum severity; messages below it are dropped.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel parses a worker's -loglevel flag value, defaulting to LevelInfo
+// for anything unrecognized.
+func ParseLevel(s string) Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	default:
+		return LevelInfo
+	}
+}
+
+// Logger writes structured log lines carrying a fixed set of key/value
+// fields, attached once via WithField and inherited by every line written
+// from the derived Logger on. Deriving one is cheap (WithField copies the
+// field map), so a handler builds one up as context accumulates down a call
+// chain instead of mutating a shared logger.
+type Logger struct {
+	out    io.Writer
+	level  Level
+	text   bool // true emits a human-readable line instead of JSON, for TTYs
+	fields map[string]string
+}
+
+var (
+	mu   sync.Mutex
+	base = &Logger{out: os.Stdout, level: LevelInfo, text: isTTY(os.Stdout)}
+)
+
+// SetLevel sets the minimum level Root() loggers write at; wired to the
+// worker's -loglevel flag.
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	base.level = l
+}
+
+// Root returns a fresh Logger with no fields of its own, using the package's
+// current output and level settings. Callers attach their own identifying
+// fields (e.g. worker_id) via WithField before handing it out further.
+func Root() *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	return &Logger{out: base.out, level: base.level, text: base.text}
+}
+
+func isTTY(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// WithField returns a derived Logger that includes key in every line it
+// writes from here on, alongside whatever fields the receiver already had.
+func (l *Logger) WithField(key, value string) *Logger {
+	fields := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{out: l.out, level: l.level, text: l.text, fields: fields}
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying l, retrievable later via FromContext.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the Logger stashed in ctx by NewContext, or a bare
+// Root() logger if none was stashed, so a caller that forgot to thread ctx
+// still logs something instead of panicking.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return l
+	}
+	return Root()
+}
+
+func (l *Logger) log(level Level, msg string) {
+	if level < l.level {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if l.text {
+		l.writeText(level, msg)
+		return
+	}
+	l.writeJSON(level, msg)
+}
+
+func (l *Logger) writeJSON(level Level, msg string) {
+	line := make(map[string]interface{}, len(l.fields)+3)
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = msg
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	json.NewEncoder(l.out).Encode(line)
+}
+
+func (l *Logger) writeText(level Level, msg string) {
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(l.out, "%s [%s] %s", time.Now().Format(time.RFC3339), level.String(), msg)
+	for _, k := range keys {
+		fmt.Fprintf(l.out, " %s=%s", k, l.fields[k])
+	}
+	fmt.Fprintln(l.out)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.log(LevelDebug, fmt.Sprintf(format, args...)) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.log(LevelInfo, fmt.Sprintf(format, args...)) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.log(LevelWarn, fmt.Sprintf(format, args...)) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.log(LevelError, fmt.Sprintf(format, args...)) }
+
+// Println mirrors the subset of log.Logger's API worker.go's existing call
+// sites use, logged at LevelInfo, so most of those sites are a drop-in
+// rename rather than a rewrite.
+func (l *Logger) Println(args ...interface{}) {
+	l.log(LevelInfo, strings.TrimRight(fmt.Sprintln(args...), "\n"))
+}